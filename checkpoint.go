@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkpointFlushInterval is how often --state-file is written to disk.
+const checkpointFlushInterval = 30 * time.Second
+
+// workItem pairs a key with the sequence number it was listed at. The
+// sequence number is assigned once, by the single producer goroutine
+// that lists keys (in ascending order), and travels with the key through
+// the names channel - unlike dequeue order, it can't be reordered by
+// however the worker pool happens to schedule, so it's what watermark
+// uses to detect a truly-completed prefix.
+type workItem struct {
+	key string
+	seq int64
+}
+
+// watermark tracks the highest sequence number N such that every key
+// with seq <= N has been acknowledged, even though up to `parallelity`
+// workers finish keys out of order. A finish for the next-expected
+// sequence number advances safeKey directly; anything that finishes
+// early is parked in pending until the gap closes, so the watermark can
+// never race ahead of work that's still in flight - the exact property
+// --resume needs to avoid skipping an unprocessed object.
+type watermark struct {
+	mu      sync.Mutex
+	nextSeq int64
+	pending map[int64]string
+	safeKey string
+}
+
+func (w *watermark) finish(seq int64, key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq != w.nextSeq {
+		if w.pending == nil {
+			w.pending = make(map[int64]string)
+		}
+		w.pending[seq] = key
+		return
+	}
+	w.safeKey = key
+	w.nextSeq++
+	for {
+		next, ok := w.pending[w.nextSeq]
+		if !ok {
+			break
+		}
+		w.safeKey = next
+		delete(w.pending, w.nextSeq)
+		w.nextSeq++
+	}
+}
+
+func (w *watermark) safe() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.safeKey
+}
+
+// checkpointState is the on-disk shape of --state-file.
+type checkpointState struct {
+	LastSafeKey      string `json:"lastSafeKey"`
+	CopiedObjects    int64  `json:"copiedObjects"`
+	ProcessedObjects int64  `json:"processedObjects"`
+	CopiedBytes      int64  `json:"copiedBytes"`
+	// Args is the CLI invocation (os.Args[1:] without --resume,
+	// space-joined) the checkpoint was written under, so a --resume with different
+	// bucket names/cache-control/regex etc. is refused rather than
+	// silently producing inconsistent results.
+	Args string `json:"args"`
+}
+
+func currentArgs() string {
+	var args []string
+	for _, arg := range os.Args[1:] {
+		// --resume is left out so a resumed run compares equal to the
+		// run that wrote the checkpoint.
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if strings.HasPrefix(arg, "-") && name == "resume" {
+			continue
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// loadCheckpoint reads path and refuses it if it was written by a
+// different CLI invocation than the current one.
+func loadCheckpoint(path string) (*checkpointState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading state file %q: %v", path, err)
+	}
+	var state checkpointState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parsing state file %q: %v", path, err)
+	}
+	if state.Args != currentArgs() {
+		return nil, fmt.Errorf("refusing to resume: state file %q was written for a different invocation\n  then: %s\n  now:  %s",
+			path, state.Args, currentArgs())
+	}
+	return &state, nil
+}
+
+// saveCheckpoint atomically overwrites path with the current progress,
+// via write-to-temp-file + rename so a crash mid-write never corrupts
+// the previous checkpoint.
+func saveCheckpoint(context *CopyContext, path string) error {
+	state := checkpointState{
+		LastSafeKey:      context.watermark.safe(),
+		CopiedObjects:    context.copiedObjects,
+		ProcessedObjects: context.processedObjects,
+		CopiedBytes:      context.copiedBytes,
+		Args:             currentArgs(),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runCheckpointFlusher periodically writes context's progress to path
+// until stop is closed. Call saveCheckpoint once more after stop is
+// closed (and workers have drained) to capture final progress.
+func runCheckpointFlusher(context *CopyContext, path string, stop <-chan struct{}) {
+	ticker := time.NewTicker(checkpointFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := saveCheckpoint(context, path); err != nil {
+				os.Stderr.WriteString(fmt.Sprintf("Failed to write state file %q: %v\n", path, err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
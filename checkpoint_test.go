@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestWatermarkAdvancesInOrder(t *testing.T) {
+	w := &watermark{}
+	w.finish(0, "a")
+	if got := w.safe(); got != "a" {
+		t.Fatalf("safe() = %q, want %q", got, "a")
+	}
+	w.finish(1, "b")
+	if got := w.safe(); got != "b" {
+		t.Fatalf("safe() = %q, want %q", got, "b")
+	}
+}
+
+func TestWatermarkParksOutOfOrderFinishes(t *testing.T) {
+	w := &watermark{}
+	// seq 1 finishes before seq 0: the watermark must not advance past
+	// "a" yet, since seq 0 is still in flight.
+	w.finish(1, "b")
+	if got := w.safe(); got != "" {
+		t.Fatalf("safe() = %q, want empty until seq 0 finishes", got)
+	}
+
+	// seq 0 finishing now closes the gap and also drains the parked seq 1.
+	w.finish(0, "a")
+	if got := w.safe(); got != "b" {
+		t.Fatalf("safe() = %q, want %q after gap closes", got, "b")
+	}
+}
+
+func TestWatermarkDrainsMultiplePendingFinishes(t *testing.T) {
+	w := &watermark{}
+	w.finish(2, "c")
+	w.finish(1, "b")
+	if got := w.safe(); got != "" {
+		t.Fatalf("safe() = %q, want empty while seq 0 is outstanding", got)
+	}
+	w.finish(0, "a")
+	if got := w.safe(); got != "c" {
+		t.Fatalf("safe() = %q, want %q once the whole prefix is acknowledged", got, "c")
+	}
+}
+
+func TestWatermarkNeverRacesAheadOfInFlightWork(t *testing.T) {
+	w := &watermark{}
+	for _, seq := range []int64{4, 3, 2} {
+		w.finish(seq, "late")
+		if got := w.safe(); got != "" {
+			t.Fatalf("safe() = %q after seq %d finished, want empty: seq 0/1 still outstanding", got, seq)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Package pacer paces requests against an S3-compatible endpoint. It
+// retries throttling and transient errors with exponential backoff and
+// jitter, and adapts a shared inter-request delay so a pool of workers
+// backs off automatically once the endpoint starts returning 503
+// SlowDown and speeds back up once it stops. This is the same approach
+// rclone's S3 backend uses via its lib/pacer package.
+package pacer
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	// MinDelay is the floor the adaptive inter-request delay decays to.
+	MinDelay = 10 * time.Millisecond
+	// MaxDelay is the ceiling the adaptive inter-request delay grows to.
+	MaxDelay = 2 * time.Second
+	// successesToHalve is the number of consecutive non-throttled
+	// requests required before the delay is halved again.
+	successesToHalve = 10
+)
+
+// Pacer retries retryable errors with exponential backoff and jitter, up
+// to MaxAttempts, while adapting a shared delay applied before every call.
+type Pacer struct {
+	MaxAttempts int
+
+	mu            sync.Mutex
+	delay         time.Duration
+	consecutiveOK int
+
+	retries int64
+}
+
+// New returns a Pacer that retries up to maxAttempts times.
+func New(maxAttempts int) *Pacer {
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	return &Pacer{MaxAttempts: maxAttempts, delay: MinDelay}
+}
+
+// Delay returns the pacer's current inter-request delay.
+func (p *Pacer) Delay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.delay
+}
+
+// Retries returns the total number of retryable failures seen so far,
+// including a failure on the final attempt that is not retried.
+func (p *Pacer) Retries() int64 {
+	return atomic.LoadInt64(&p.retries)
+}
+
+func (p *Pacer) wait() {
+	time.Sleep(p.Delay())
+}
+
+func (p *Pacer) onThrottled() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.consecutiveOK = 0
+	p.delay *= 2
+	if p.delay > MaxDelay {
+		p.delay = MaxDelay
+	}
+}
+
+func (p *Pacer) onSuccess() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.consecutiveOK++
+	if p.consecutiveOK >= successesToHalve {
+		p.consecutiveOK = 0
+		p.delay /= 2
+		if p.delay < MinDelay {
+			p.delay = MinDelay
+		}
+	}
+}
+
+// IsRetryable reports whether err is a throttling or transient S3 error
+// worth retrying: SlowDown, RequestTimeout, InternalError, and any 5xx
+// response.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500
+	}
+	return false
+}
+
+// Do calls fn, retrying it with exponential backoff and jitter while
+// fn's error is retryable, up to MaxAttempts. The pacer's shared
+// inter-request delay is applied before every attempt, and is doubled on
+// a throttling error (capped at MaxDelay) or halved after a run of
+// successes (floored at MinDelay).
+func (p *Pacer) Do(fn func() error) error {
+	var lastErr error
+	for attempt := 0; attempt < p.MaxAttempts; attempt++ {
+		p.wait()
+		err := fn()
+		if err == nil {
+			p.onSuccess()
+			return nil
+		}
+		lastErr = err
+		if !IsRetryable(err) {
+			return err
+		}
+		atomic.AddInt64(&p.retries, 1)
+		p.onThrottled()
+
+		backoff := time.Duration(1<<uint(attempt)) * 100 * time.Millisecond
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+		jitter := time.Duration(rand.Int63n(int64(backoff) + 1))
+		time.Sleep(backoff/2 + jitter/2)
+	}
+	return lastErr
+}
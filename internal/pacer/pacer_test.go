@@ -0,0 +1,140 @@
+package pacer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("boom"), false},
+		{"SlowDown", awserr.New("SlowDown", "slow down", nil), true},
+		{"RequestTimeout", awserr.New("RequestTimeout", "timeout", nil), true},
+		{"InternalError", awserr.New("InternalError", "oops", nil), true},
+		{"ServiceUnavailable", awserr.New("ServiceUnavailable", "unavailable", nil), true},
+		{"NoSuchKey", awserr.New("NoSuchKey", "not found", nil), false},
+		{"502 via RequestFailure", awserr.NewRequestFailure(awserr.New("BadGateway", "bad gateway", nil), 502, "req-1"), true},
+		{"404 via RequestFailure", awserr.NewRequestFailure(awserr.New("NotFound", "not found", nil), 404, "req-2"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := IsRetryable(c.err); got != c.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestOnThrottledDoublesDelayUpToMax(t *testing.T) {
+	p := New(1)
+	p.delay = MaxDelay / 2
+	p.onThrottled()
+	if p.Delay() != MaxDelay {
+		t.Fatalf("delay = %v, want %v", p.Delay(), MaxDelay)
+	}
+	p.onThrottled()
+	if p.Delay() != MaxDelay {
+		t.Fatalf("delay should stay capped at %v, got %v", MaxDelay, p.Delay())
+	}
+}
+
+func TestOnSuccessHalvesDelayAfterConsecutiveSuccesses(t *testing.T) {
+	p := New(1)
+	p.delay = MinDelay * 4
+	for i := 0; i < successesToHalve-1; i++ {
+		p.onSuccess()
+	}
+	if p.Delay() != MinDelay*4 {
+		t.Fatalf("delay should not change before successesToHalve successes, got %v", p.Delay())
+	}
+	p.onSuccess()
+	if p.Delay() != MinDelay*2 {
+		t.Fatalf("delay = %v, want %v after successesToHalve successes", p.Delay(), MinDelay*2)
+	}
+}
+
+func TestOnSuccessFloorsAtMinDelay(t *testing.T) {
+	p := New(1)
+	p.delay = MinDelay
+	for i := 0; i < successesToHalve; i++ {
+		p.onSuccess()
+	}
+	if p.Delay() != MinDelay {
+		t.Fatalf("delay = %v, want floor %v", p.Delay(), MinDelay)
+	}
+}
+
+func TestDoReturnsImmediatelyOnNonRetryableError(t *testing.T) {
+	p := New(5)
+	wantErr := awserr.New("AccessDenied", "nope", nil)
+	calls := 0
+	err := p.Do(func() error {
+		calls++
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("err = %v, want %v", err, wantErr)
+	}
+	if calls != 1 {
+		t.Fatalf("fn called %d times, want 1", calls)
+	}
+	if p.Retries() != 0 {
+		t.Fatalf("Retries() = %d, want 0", p.Retries())
+	}
+}
+
+func TestDoRetriesRetryableErrorsUpToMaxAttempts(t *testing.T) {
+	p := New(3)
+	p.delay = 0 // skip the inter-request delay; the backoff between attempts still sleeps
+	retryable := awserr.New("SlowDown", "slow down", nil)
+	calls := 0
+	err := p.Do(func() error {
+		calls++
+		return retryable
+	})
+	if err != retryable {
+		t.Fatalf("err = %v, want %v", err, retryable)
+	}
+	if calls != 3 {
+		t.Fatalf("fn called %d times, want MaxAttempts=3", calls)
+	}
+	if p.Retries() != 3 {
+		t.Fatalf("Retries() = %d, want 3", p.Retries())
+	}
+}
+
+func TestDoSucceedsAfterRetries(t *testing.T) {
+	p := New(3)
+	p.delay = 0
+	calls := 0
+	err := p.Do(func() error {
+		calls++
+		if calls < 2 {
+			return awserr.New("SlowDown", "slow down", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if calls != 2 {
+		t.Fatalf("fn called %d times, want 2", calls)
+	}
+	if p.Retries() != 1 {
+		t.Fatalf("Retries() = %d, want 1", p.Retries())
+	}
+}
+
+func TestNewClampsNonPositiveMaxAttempts(t *testing.T) {
+	p := New(0)
+	if p.MaxAttempts != 1 {
+		t.Fatalf("MaxAttempts = %d, want 1", p.MaxAttempts)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestParseInventoryFilterEmptyMatchesEverything(t *testing.T) {
+	f, err := parseInventoryFilter("  ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !f.matches(map[string]string{"Key": "anything"}) {
+		t.Fatalf("nil filter should match everything")
+	}
+}
+
+func TestParseInventoryFilterSingleClause(t *testing.T) {
+	f, err := parseInventoryFilter(`StorageClass=="STANDARD"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !f.matches(map[string]string{"StorageClass": "STANDARD"}) {
+		t.Fatalf("expected match on equal StorageClass")
+	}
+	if f.matches(map[string]string{"StorageClass": "GLACIER"}) {
+		t.Fatalf("expected no match on different StorageClass")
+	}
+}
+
+func TestParseInventoryFilterConjunction(t *testing.T) {
+	f, err := parseInventoryFilter(`Size<5368709120 && StorageClass=="STANDARD"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	row := map[string]string{"Size": "1024", "StorageClass": "STANDARD"}
+	if !f.matches(row) {
+		t.Fatalf("expected row to match both clauses")
+	}
+	row["StorageClass"] = "GLACIER"
+	if f.matches(row) {
+		t.Fatalf("expected row to fail the StorageClass clause")
+	}
+}
+
+func TestParseInventoryFilterLongestOpMatchedFirst(t *testing.T) {
+	f, err := parseInventoryFilter("Size<=100")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !f.matches(map[string]string{"Size": "100"}) {
+		t.Fatalf("<= should match an equal value, not be misparsed as <")
+	}
+	if f.matches(map[string]string{"Size": "101"}) {
+		t.Fatalf("<= should not match a larger value")
+	}
+}
+
+func TestParseInventoryFilterInvalidClause(t *testing.T) {
+	if _, err := parseInventoryFilter("not-a-clause"); err == nil {
+		t.Fatalf("expected an error for a clause with no recognized operator")
+	}
+}
+
+func TestInventoryFilterSizeComparisonIsNumeric(t *testing.T) {
+	f, err := parseInventoryFilter("Size>9")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Lexicographic comparison would say "10" < "9"; numeric must not.
+	if !f.matches(map[string]string{"Size": "10"}) {
+		t.Fatalf("Size comparison must be numeric, not lexicographic")
+	}
+}
+
+func TestInventoryFilterMissingFieldNeverMatches(t *testing.T) {
+	f, err := parseInventoryFilter(`StorageClass=="STANDARD"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.matches(map[string]string{"Key": "foo"}) {
+		t.Fatalf("a row missing the filtered field should never match")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metrics bundles the Prometheus collectors exposed on --metrics-listen.
+// It replaces the ad-hoc statusStats/typeStats/storageClassStats maps so
+// the stdout status line and a scrape always report the same numbers.
+type Metrics struct {
+	ObjectsProcessed  *prometheus.CounterVec
+	TypeStats         *prometheus.CounterVec
+	StorageClassStats *prometheus.CounterVec
+	ObjectsCopied     prometheus.Counter
+	BytesCopied       prometheus.Counter
+	ObjectsExpected   prometheus.Gauge
+	CopyDuration      prometheus.Histogram
+	S3Errors          *prometheus.CounterVec
+	HeadLatency       *prometheus.HistogramVec
+}
+
+func newMetrics() *Metrics {
+	m := &Metrics{
+		ObjectsProcessed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3assets_objects_processed_total",
+			Help: "Number of objects processed, broken down by copy status character.",
+		}, []string{"status"}),
+		TypeStats: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3assets_content_type_stats_total",
+			Help: "Number of objects processed, broken down by Content-Type.",
+		}, []string{"content_type"}),
+		StorageClassStats: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3assets_storage_class_stats_total",
+			Help: "Number of objects whose storage class was transitioned vs. kept.",
+		}, []string{"outcome"}),
+		ObjectsCopied: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "s3assets_objects_copied_total",
+			Help: "Number of objects actually copied.",
+		}),
+		BytesCopied: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "s3assets_bytes_copied_total",
+			Help: "Number of bytes copied.",
+		}),
+		ObjectsExpected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "s3assets_objects_expected",
+			Help: "Expected number of objects in the source bucket.",
+		}),
+		CopyDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "s3assets_copy_duration_seconds",
+			Help:    "Time to process a single object, from HeadObject to the end of the copy.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		S3Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3assets_s3_api_errors_total",
+			Help: "Number of S3 API errors, by operation and error code.",
+		}, []string{"op", "code"}),
+		HeadLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "s3assets_head_latency_seconds",
+			Help:    "Latency of individual S3 operations, by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op"}),
+	}
+	prometheus.MustRegister(
+		m.ObjectsProcessed,
+		m.TypeStats,
+		m.StorageClassStats,
+		m.ObjectsCopied,
+		m.BytesCopied,
+		m.ObjectsExpected,
+		m.CopyDuration,
+		m.S3Errors,
+		m.HeadLatency,
+	)
+	return m
+}
+
+// startMetricsServer starts the /metrics HTTP endpoint in the background.
+func startMetricsServer(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("metrics server on %s failed: %v\n", listen, err))
+		}
+	}()
+}
+
+// recordS3Error increments s3assets_s3_api_errors_total for a failed S3
+// API call, extracting the AWS error code when possible.
+func (m *Metrics) recordS3Error(op string, err error) {
+	code := "unknown"
+	if aerr, ok := err.(awserr.Error); ok {
+		code = aerr.Code()
+	}
+	m.S3Errors.WithLabelValues(op, code).Inc()
+}
+
+// counterVecSnapshot reads back the current values of a CounterVec,
+// keyed by the given label, so the periodic stdout status line can
+// print the same numbers a Prometheus scrape would see.
+func counterVecSnapshot(cv *prometheus.CounterVec, label string) map[string]int {
+	ch := make(chan prometheus.Metric, 64)
+	go func() {
+		cv.Collect(ch)
+		close(ch)
+	}()
+	out := make(map[string]int)
+	for metric := range ch {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			continue
+		}
+		key := ""
+		for _, lp := range pb.Label {
+			if lp.GetName() == label {
+				key = lp.GetValue()
+			}
+		}
+		out[key] = int(pb.Counter.GetValue())
+	}
+	return out
+}
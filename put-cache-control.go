@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"github.com/Galeria-Kaufhof/s3-assets-toolkit/internal/pacer"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -15,12 +16,21 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// S3 rejects CopyObject for sources larger than 5 GiB, so anything at or
+// above this size has to go through the multipart-copy path instead.
+const defaultMultipartThreshold = 5 * 1024 * 1024 * 1024 // 5 GiB
+
+// Size of each part uploaded via UploadPartCopy when multipart-copying a
+// large object. Keep well under the 10,000 parts/object S3 limit.
+const defaultMultipartPartSize = 512 * 1024 * 1024 // 512 MiB
+
 func assumeRoleCrossAccount(role string) (*aws.Config, error) {
 	security := sts.New(session.New())
 	input := &sts.AssumeRoleInput{
@@ -94,17 +104,20 @@ func getExpectedSize(context *CopyContext) {
 		context.expectedObjects = 0 // unknown
 		return
 	}
+	context.metrics.ObjectsExpected.Set(float64(context.expectedObjects))
 	fmt.Printf("Objects to copy/check: %d\n", context.expectedObjects)
 }
 
-func listObjectsFromStdin(names chan<- string) {
+func listObjectsFromStdin(names chan<- workItem) {
+	var seq int64
 	input := bufio.NewScanner(os.Stdin)
 	for input.Scan() {
-		names <- input.Text()
+		names <- workItem{key: input.Text(), seq: seq}
+		seq++
 	}
 }
 
-func listObjectsToCopy(names chan<- string, bucketname string, continueFromKey string, context *CopyContext) {
+func listObjectsToCopy(names chan<- workItem, bucketname string, continueFromKey string, context *CopyContext) {
 	input := &s3.ListObjectsV2Input{
 		Bucket:  aws.String(bucketname),
 		MaxKeys: aws.Int64(1000),
@@ -113,12 +126,14 @@ func listObjectsToCopy(names chan<- string, bucketname string, continueFromKey s
 		input.StartAfter = &continueFromKey
 	}
 
-	err := context.s3svc.ListObjectsV2Pages(input,
+	var seq int64
+	err := context.fromSvc.ListObjectsV2Pages(input,
 		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 			// Could use following if cloudwatch based metrics are not available:
 			// atomic.AddInt64(&context.expectedObjects, int64(len(page.Contents)))
 			for _, item := range page.Contents {
-				names <- *item.Key
+				names <- workItem{key: *item.Key, seq: seq}
+				seq++
 			}
 			// stop pumping names once we have copied enough
 			return context.copiedObjects < context.maxObjectsToCopy
@@ -168,10 +183,115 @@ func main() {
 			Name:  "continue, u",
 			Usage: "do not start over, continue from given key",
 		},
+		cli.StringFlag{
+			Name:  "state-file",
+			Usage: "periodically write progress to this path (atomically,\n\tvia rename) so --resume can pick up where a crashed or\n\tkilled run left off",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "resume from --state-file instead of starting over;\n\trefuses to run if the file was written for a different\n\tinvocation",
+		},
 		cli.BoolFlag{
 			Name:  "stdin",
 			Usage: "take file names to copy from stdin",
 		},
+		cli.StringFlag{
+			Name:  "inventory",
+			Usage: "s3://bucket/path/manifest.json of an S3 Inventory\n\treport (CSV format); streams its Key column instead of\n\tListObjectsV2, much cheaper for buckets with tens of\n\tmillions of objects",
+		},
+		cli.StringFlag{
+			Name: "inventory-filter",
+			Usage: "filter inventory rows before copying, e.g.\n" +
+				`'Size<5368709120 && StorageClass=="STANDARD"'; only` +
+				"\n\ttakes effect together with --inventory",
+		},
+		cli.Int64Flag{
+			Name:  "multipart-threshold-mb",
+			Value: defaultMultipartThreshold / 1024 / 1024,
+			Usage: "objects at or above this size use multipart server-side\n\tcopy instead of CopyObject, which S3 rejects above 5 GiB",
+		},
+		cli.Int64Flag{
+			Name:  "multipart-part-size-mb",
+			Value: defaultMultipartPartSize / 1024 / 1024,
+			Usage: "size of each part when multipart-copying a large object",
+		},
+		cli.IntFlag{
+			Name:  "multipart-concurrency",
+			Usage: "parallel UploadPartCopy calls per object; defaults to\n\t--parallelity",
+		},
+		cli.StringFlag{
+			Name:  "storage-class",
+			Usage: "STANDARD, STANDARD_IA, ONEZONE_IA, INTELLIGENT_TIERING,\n\tGLACIER or DEEP_ARCHIVE; if omitted, the source object's\n\tstorage class is preserved instead of reset to STANDARD",
+		},
+		cli.StringFlag{
+			Name:  "sse",
+			Usage: "server-side encryption to apply: AES256 or aws:kms; if\n\tomitted, the source object's SSE setting is preserved",
+		},
+		cli.StringFlag{
+			Name:  "sse-kms-key-id",
+			Usage: "KMS key id/ARN to use when --sse=aws:kms",
+		},
+		cli.StringFlag{
+			Name:  "sse-c-key",
+			Usage: "base64-encoded 256-bit key for SSE-C; can not be\n\tpreserved automatically since S3 never returns it",
+		},
+		cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "address to expose Prometheus metrics on, e.g. :9090;\n\tunset disables the metrics server",
+		},
+		cli.StringFlag{
+			Name:  "endpoint-url",
+			Usage: "custom S3-compatible endpoint (MinIO, Ceph, Wasabi, GCS, ...)\n\tused for both buckets unless overridden below",
+		},
+		cli.StringFlag{
+			Name:  "from-endpoint-url",
+			Usage: "custom endpoint for the 'from' bucket; overrides --endpoint-url",
+		},
+		cli.StringFlag{
+			Name:  "target-endpoint-url",
+			Usage: "custom endpoint for the target bucket; overrides --endpoint-url",
+		},
+		cli.StringFlag{
+			Name:  "region",
+			Usage: "region to use for custom endpoints that don't support\n\tregion autodetection",
+		},
+		cli.StringFlag{
+			Name:  "access-key-id",
+			Usage: "static access key id, used for both buckets unless\n\toverridden below; if unset, falls back to the default AWS\n\tcredential chain (env vars, ~/.aws, instance role, ...)",
+		},
+		cli.StringFlag{
+			Name:  "secret-access-key",
+			Usage: "static secret access key that pairs with --access-key-id",
+		},
+		cli.StringFlag{
+			Name:  "from-access-key-id",
+			Usage: "static access key id for the 'from' bucket; overrides\n\t--access-key-id, e.g. when 'from' is AWS and target is MinIO",
+		},
+		cli.StringFlag{
+			Name:  "from-secret-access-key",
+			Usage: "static secret access key that pairs with --from-access-key-id",
+		},
+		cli.StringFlag{
+			Name:  "target-access-key-id",
+			Usage: "static access key id for the target bucket; overrides\n\t--access-key-id",
+		},
+		cli.StringFlag{
+			Name:  "target-secret-access-key",
+			Usage: "static secret access key that pairs with --target-access-key-id",
+		},
+		cli.BoolFlag{
+			Name:  "force-path-style",
+			Usage: "use path-style addressing (endpoint/bucket/key); required by\n\tmost non-AWS S3-compatible endpoints",
+		},
+		cli.BoolFlag{
+			Name:  "disable-ssl",
+			Usage: "use plain HTTP against the endpoint",
+		},
+		cli.IntFlag{
+			Name:  "max-retries",
+			Value: 10,
+			Usage: "max attempts per S3 call before giving up on\n\tSlowDown/RequestTimeout/InternalError/5xx responses",
+		},
 		cli.StringFlag{
 			Name: "cross-account-cloudwatch-role, r",
 			Usage: `
@@ -189,25 +309,62 @@ func main() {
 	app.Action = func(c *cli.Context) error {
 		context, _ := prepareContextFromCli(c)
 
+		continueFromKey := c.GlobalString("continue")
+		stateFile := c.GlobalString("state-file")
+		if c.GlobalBool("resume") {
+			if stateFile == "" {
+				return cli.NewExitError("\n\nError: --resume requires --state-file\n", 1)
+			}
+			state, err := loadCheckpoint(stateFile)
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("\n\nError: %v\n", err), 1)
+			}
+			continueFromKey = state.LastSafeKey
+			context.copiedObjects = state.CopiedObjects
+			context.processedObjects = state.ProcessedObjects
+			context.copiedBytes = state.CopiedBytes
+			fmt.Printf("Resuming from %q (%d objects copied, %d processed so far)\n",
+				continueFromKey, context.copiedObjects, context.processedObjects)
+		}
+
 		// set well below the typical ulimit of 1024 - TODO add to docs
 		// to avoid "socket: too many open files".
 		// Also fits AWS API limits, avoid "503 SlowDown: Please reduce your request rate."
 		parallelity := c.GlobalInt("parallelity")
 
-		names := make(chan string, 3000)
+		names := make(chan workItem, 3000)
 		context.wg.Add(parallelity)
 		for gr := 1; gr <= parallelity; gr++ {
 			go cpworker(&context, names)
 		}
 
-		getExpectedSize(&context)
-		if c.GlobalBool("stdin") {
-			listObjectsFromStdin(names)
+		var stopFlusher chan struct{}
+		if stateFile != "" {
+			stopFlusher = make(chan struct{})
+			go runCheckpointFlusher(&context, stateFile, stopFlusher)
+		}
+
+		inventory := c.GlobalString("inventory")
+		if inventory != "" {
+			// expectedObjects is populated from the inventory's row
+			// count as it streams, instead of a CloudWatch lookup.
+			listObjectsFromInventory(names, inventory, c.GlobalString("inventory-filter"), continueFromKey, &context)
 		} else {
-			listObjectsToCopy(names, context.from, c.GlobalString("continue"), &context)
+			getExpectedSize(&context)
+			if c.GlobalBool("stdin") {
+				listObjectsFromStdin(names)
+			} else {
+				listObjectsToCopy(names, context.from, continueFromKey, &context)
+			}
 		}
 		close(names)
 		context.wg.Wait()
+		if stopFlusher != nil {
+			close(stopFlusher)
+			if err := saveCheckpoint(&context, stateFile); err != nil {
+				os.Stderr.WriteString(fmt.Sprintf("Failed to write final state file %q: %v\n", stateFile, err))
+			}
+		}
 		fmt.Printf("\nDone.\n")
 		return nil
 	}
@@ -219,7 +376,13 @@ func CheckPublicCommentTmp() {
 
 /* CopyContext defines context for running concurrent copy operations and remembers the progress */
 type CopyContext struct {
-	s3svc          *s3.S3
+	fromSvc   *s3.S3
+	targetSvc *s3.S3
+	// crossProvider is true when the 'from' and target endpoints differ,
+	// in which case server-side CopyObject/UploadPartCopy can't work
+	// (they only copy within one provider) and a streamed GET+PUT is
+	// used instead.
+	crossProvider  bool
 	target         string
 	from           string
 	newvalue       string
@@ -227,6 +390,15 @@ type CopyContext struct {
 	cloudwatchRole string
 	noop           bool
 
+	multipartThreshold   int64
+	multipartPartSize    int64
+	multipartConcurrency int
+
+	storageClass string
+	sse          string
+	sseKmsKeyID  string
+	sseCKey      string
+
 	copiedObjects    int64
 	maxObjectsToCopy int64
 	processedObjects int64 // including ignored and skipped
@@ -236,8 +408,9 @@ type CopyContext struct {
 	statusLineMutex  sync.Mutex
 	lastStatusShown  float64
 	statsMutex       sync.Mutex
-	statusStats      map[string]int
-	typeStats        map[string]int
+	metrics          *Metrics
+	pacer            *pacer.Pacer
+	watermark        watermark
 
 	wg sync.WaitGroup
 }
@@ -254,24 +427,22 @@ func prepareContext() (CopyContext, error) {
 	if len(os.Args) != 3 {
 		panic("Please provide bucket name and desired Cache-Control setting")
 	}
+	svc := s3.New(sess)
 	return CopyContext{
-		s3svc:           s3.New(sess),
-		target:          os.Args[1],
-		expectedObjects: 3867874,
-		newvalue:        os.Args[2],
-		start:           time.Now(),
+		fromSvc:            svc,
+		targetSvc:          svc,
+		target:             os.Args[1],
+		expectedObjects:    3867874,
+		newvalue:           os.Args[2],
+		multipartThreshold: defaultMultipartThreshold,
+		multipartPartSize:  defaultMultipartPartSize,
+		metrics:            newMetrics(),
+		pacer:              pacer.New(10),
+		start:              time.Now(),
 	}, nil
 }
 
 func prepareContextFromCli(c *cli.Context) (CopyContext, error) {
-	// Session with the new library
-	sess, err := session.NewSession() /*&aws.Config{
-		Region: aws.String("eu-central-1")},
-	)*/
-	if err != nil {
-		panic(fmt.Sprintf("Can not create AWS SDK session %s", err))
-	}
-
 	target := c.GlobalString("target-bucket")
 	if target == "" {
 		cli.ShowAppHelp(c)
@@ -289,28 +460,132 @@ func prepareContextFromCli(c *cli.Context) (CopyContext, error) {
 	if exclude_pattern == "" {
 		exclude_pattern = "^some-pattern-which-would-never-match$"
 	}
+
+	multipartConcurrency := c.GlobalInt("multipart-concurrency")
+	if multipartConcurrency == 0 {
+		multipartConcurrency = c.GlobalInt("parallelity")
+	}
+
+	metricsListen := c.GlobalString("metrics-listen")
+	metrics := newMetrics()
+	if metricsListen != "" {
+		fmt.Printf("Exposing Prometheus metrics on %s/metrics\n", metricsListen)
+		startMetricsServer(metricsListen)
+	}
+
+	region := c.GlobalString("region")
+	forcePathStyle := c.GlobalBool("force-path-style")
+	disableSSL := c.GlobalBool("disable-ssl")
+
+	fromEndpoint := c.GlobalString("from-endpoint-url")
+	if fromEndpoint == "" {
+		fromEndpoint = c.GlobalString("endpoint-url")
+	}
+	targetEndpoint := c.GlobalString("target-endpoint-url")
+	if targetEndpoint == "" {
+		targetEndpoint = c.GlobalString("endpoint-url")
+	}
+
+	fromAccessKeyID := c.GlobalString("from-access-key-id")
+	if fromAccessKeyID == "" {
+		fromAccessKeyID = c.GlobalString("access-key-id")
+	}
+	fromSecretAccessKey := c.GlobalString("from-secret-access-key")
+	if fromSecretAccessKey == "" {
+		fromSecretAccessKey = c.GlobalString("secret-access-key")
+	}
+	targetAccessKeyID := c.GlobalString("target-access-key-id")
+	if targetAccessKeyID == "" {
+		targetAccessKeyID = c.GlobalString("access-key-id")
+	}
+	targetSecretAccessKey := c.GlobalString("target-secret-access-key")
+	if targetSecretAccessKey == "" {
+		targetSecretAccessKey = c.GlobalString("secret-access-key")
+	}
+
+	fromSvc, err := newS3Client(fromEndpoint, region, forcePathStyle, disableSSL, fromAccessKeyID, fromSecretAccessKey)
+	if err != nil {
+		panic(fmt.Sprintf("Can not create AWS SDK session for 'from' bucket: %s", err))
+	}
+	targetSvc := fromSvc
+	crossProvider := fromEndpoint != targetEndpoint
+	if crossProvider || targetAccessKeyID != fromAccessKeyID {
+		targetSvc, err = newS3Client(targetEndpoint, region, forcePathStyle, disableSSL, targetAccessKeyID, targetSecretAccessKey)
+		if err != nil {
+			panic(fmt.Sprintf("Can not create AWS SDK session for target bucket: %s", err))
+		}
+	}
+	if crossProvider {
+		fmt.Printf("Cross-provider copy: 'from' endpoint %q, target endpoint %q; falling back to streamed GET+PUT\n",
+			fromEndpoint, targetEndpoint)
+	}
+
 	return CopyContext{
-		s3svc:            s3.New(sess),
-		target:           target,
-		from:             from,
-		noop:             c.GlobalBool("noop"),
-		expectedObjects:  0,
-		maxObjectsToCopy: c.GlobalInt64("first-n"),
-		newvalue:         c.GlobalString("cache-control"),
-		exclude:          *regexp.MustCompile(exclude_pattern),
-		cloudwatchRole:   c.GlobalString("cross-account-cloudwatch-role"),
-		start:            time.Now(),
-		statusStats:      make(map[string]int),
-		typeStats:        make(map[string]int),
+		fromSvc:              fromSvc,
+		targetSvc:            targetSvc,
+		crossProvider:        crossProvider,
+		target:               target,
+		from:                 from,
+		noop:                 c.GlobalBool("noop"),
+		expectedObjects:      0,
+		maxObjectsToCopy:     c.GlobalInt64("first-n"),
+		newvalue:             c.GlobalString("cache-control"),
+		exclude:              *regexp.MustCompile(exclude_pattern),
+		cloudwatchRole:       c.GlobalString("cross-account-cloudwatch-role"),
+		multipartThreshold:   c.GlobalInt64("multipart-threshold-mb") * 1024 * 1024,
+		multipartPartSize:    c.GlobalInt64("multipart-part-size-mb") * 1024 * 1024,
+		multipartConcurrency: multipartConcurrency,
+		storageClass:         c.GlobalString("storage-class"),
+		sse:                  c.GlobalString("sse"),
+		sseKmsKeyID:          c.GlobalString("sse-kms-key-id"),
+		sseCKey:              c.GlobalString("sse-c-key"),
+		metrics:              metrics,
+		pacer:                pacer.New(c.GlobalInt("max-retries")),
+		start:                time.Now(),
 	}, nil
 }
 
-func cpworker(context *CopyContext, names <-chan string) {
+// newS3Client builds an S3 client against either the standard AWS
+// endpoint (when endpoint is empty) or a custom S3-compatible endpoint
+// such as MinIO, Ceph, Wasabi or GCS. Path-style addressing and plain
+// HTTP are required by most non-AWS endpoints. accessKeyID/secretAccessKey
+// are optional; when either is empty the client falls back to the default
+// AWS credential chain, which lets --from-* and --target-* point at
+// different providers (e.g. a MinIO key pair and ambient AWS credentials)
+// without one clobbering the other.
+func newS3Client(endpoint string, region string, forcePathStyle bool, disableSSL bool, accessKeyID string, secretAccessKey string) (*s3.S3, error) {
+	cfg := aws.Config{}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+	if region != "" {
+		cfg.Region = aws.String(region)
+	}
+	if forcePathStyle {
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	if disableSSL {
+		cfg.DisableSSL = aws.Bool(true)
+	}
+	if accessKeyID != "" && secretAccessKey != "" {
+		cfg.Credentials = credentials.NewStaticCredentials(accessKeyID, secretAccessKey, "")
+	}
+	sess, err := session.NewSession(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+func cpworker(context *CopyContext, names <-chan workItem) {
 	for {
-		name, more := <-names
+		item, more := <-names
+		name := item.key
 		if more {
 			// fmt.Printf("Starting copy %v\n", name)
-			if err := cp(context, name); err != nil {
+			err := cp(context, name)
+			context.watermark.finish(item.seq, name)
+			if err != nil {
 				os.Stderr.WriteString(fmt.Sprintf("==> Failed processing '%s': %v\n", name, err))
 				filename := "error_keys.txt"
 				os.Stderr.WriteString(fmt.Sprintf("Adding name to '%s' for later processing or reference", filename))
@@ -330,6 +605,145 @@ func cpworker(context *CopyContext, names <-chan string) {
 	}
 }
 
+// sseParams holds the server-side-encryption settings to apply to a copy,
+// whether they come from an explicit CLI override or are preserved from
+// the source object's HeadObject response.
+type sseParams struct {
+	algorithm   *string
+	kmsKeyID    *string
+	customerKey *string
+}
+
+func (sse sseParams) applyToCreateMultipartUpload(inp *s3.CreateMultipartUploadInput) {
+	inp.ServerSideEncryption = sse.algorithm
+	inp.SSEKMSKeyId = sse.kmsKeyID
+	if sse.customerKey != nil {
+		inp.SSECustomerAlgorithm = aws.String("AES256")
+		inp.SSECustomerKey = sse.customerKey
+	}
+}
+
+func (sse sseParams) applyToUploadPartCopy(inp *s3.UploadPartCopyInput) {
+	if sse.customerKey != nil {
+		inp.SSECustomerAlgorithm = aws.String("AES256")
+		inp.SSECustomerKey = sse.customerKey
+	}
+}
+
+func (sse sseParams) applyToUploadPart(inp *s3.UploadPartInput) {
+	if sse.customerKey != nil {
+		inp.SSECustomerAlgorithm = aws.String("AES256")
+		inp.SSECustomerKey = sse.customerKey
+	}
+}
+
+func (sse sseParams) applyToPutObject(inp *s3.PutObjectInput) {
+	inp.ServerSideEncryption = sse.algorithm
+	inp.SSEKMSKeyId = sse.kmsKeyID
+	if sse.customerKey != nil {
+		inp.SSECustomerAlgorithm = aws.String("AES256")
+		inp.SSECustomerKey = sse.customerKey
+	}
+}
+
+// resolveStorageClass decides the storage class for a copy: an explicit
+// --storage-class flag always wins, otherwise the source object's current
+// storage class is preserved so a plain CopyObject call doesn't silently
+// reset Glacier/IA objects back to STANDARD. The bool return reports
+// whether the class was changed (transitioned) for the stats breakdown.
+func resolveStorageClass(context *CopyContext, from *s3.HeadObjectOutput) (*string, bool) {
+	current := "STANDARD"
+	if from.StorageClass != nil {
+		current = *from.StorageClass
+	}
+	if context.storageClass == "" {
+		return from.StorageClass, false
+	}
+	return aws.String(context.storageClass), context.storageClass != current
+}
+
+// resolveSSE decides the server-side-encryption settings for a copy: an
+// explicit --sse/--sse-kms-key-id flag always wins, otherwise the source
+// object's SSE/KMS settings are preserved. SSE-C can never be preserved
+// automatically since S3 never returns the customer key, so --sse-c-key
+// must be supplied explicitly whenever it applies. SSE-C is mutually
+// exclusive with SSE-S3/SSE-KMS on the same request, so supplying
+// --sse-c-key always clears any preserved algorithm/KMS key, even
+// without an explicit --sse override.
+func resolveSSE(context *CopyContext, from *s3.HeadObjectOutput) sseParams {
+	sse := sseParams{
+		algorithm: from.ServerSideEncryption,
+		kmsKeyID:  from.SSEKMSKeyId,
+	}
+	if context.sse != "" {
+		sse.algorithm = aws.String(context.sse)
+		sse.kmsKeyID = nil
+	}
+	if context.sseKmsKeyID != "" {
+		sse.kmsKeyID = aws.String(context.sseKmsKeyID)
+	}
+	if context.sseCKey != "" {
+		sse.customerKey = aws.String(context.sseCKey)
+		sse.algorithm = nil
+		sse.kmsKeyID = nil
+	}
+	return sse
+}
+
+// targetUpToDate reports whether target's storage class and SSE already
+// match storageClass/sse, i.e. this run wouldn't change anything beyond
+// CacheControl/ContentType - callers still need to check those
+// separately before skipping a copy. SSE-C can never be verified this
+// way, since S3 never returns the customer key back on HeadObject, so an
+// explicit --sse-c-key always forces a copy.
+func targetUpToDate(target *s3.HeadObjectOutput, storageClass *string, sse sseParams) bool {
+	if sse.customerKey != nil {
+		return false
+	}
+
+	targetClass := "STANDARD"
+	if target.StorageClass != nil {
+		targetClass = *target.StorageClass
+	}
+	wantClass := "STANDARD"
+	if storageClass != nil {
+		wantClass = *storageClass
+	}
+	if targetClass != wantClass {
+		return false
+	}
+
+	var targetAlgorithm, wantAlgorithm string
+	if target.ServerSideEncryption != nil {
+		targetAlgorithm = *target.ServerSideEncryption
+	}
+	if sse.algorithm != nil {
+		wantAlgorithm = *sse.algorithm
+	}
+	if targetAlgorithm != wantAlgorithm {
+		return false
+	}
+
+	var targetKMSKeyID, wantKMSKeyID string
+	if target.SSEKMSKeyId != nil {
+		targetKMSKeyID = *target.SSEKMSKeyId
+	}
+	if sse.kmsKeyID != nil {
+		wantKMSKeyID = *sse.kmsKeyID
+	}
+	return targetKMSKeyID == wantKMSKeyID
+}
+
+// applySSE sets the server-side-encryption headers on a CopyObjectInput.
+func applySSE(inp *s3.CopyObjectInput, sse sseParams) {
+	inp.ServerSideEncryption = sse.algorithm
+	inp.SSEKMSKeyId = sse.kmsKeyID
+	if sse.customerKey != nil {
+		inp.SSECustomerAlgorithm = aws.String("AES256")
+		inp.SSECustomerKey = sse.customerKey
+	}
+}
+
 func IsPicture(meta *s3.HeadObjectOutput) bool {
 	switch *meta.ContentType {
 	case
@@ -361,30 +775,51 @@ func cp(context *CopyContext, name string) error {
 	//fmt.Println(url.PathEscape(name))
 	// key := aws.String(url.PathEscape(name)),
 	key := name
-	from, fromErr := context.s3svc.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(context.from),
-		Key:    aws.String(key),
+	opStart := time.Now()
+
+	headSourceStart := time.Now()
+	var from *s3.HeadObjectOutput
+	fromErr := context.pacer.Do(func() error {
+		var err error
+		from, err = context.fromSvc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(context.from),
+			Key:    aws.String(key),
+		})
+		return err
 	})
+	context.metrics.HeadLatency.WithLabelValues("head-source").Observe(time.Since(headSourceStart).Seconds())
 	if fromErr != nil {
+		context.metrics.recordS3Error("head-source", fromErr)
 		return fmt.Errorf("\naws sdk Head for `%s` failed: \n%T\n%v\n", key, fromErr, fromErr)
 	}
 
 	contenttype := from.ContentType
+	storageClass, transitioned := resolveStorageClass(context, from)
+	sseInput := resolveSSE(context, from)
 
-	target, targetErr := context.s3svc.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(context.target),
-		Key:    aws.String(key),
+	headTargetStart := time.Now()
+	var target *s3.HeadObjectOutput
+	targetErr := context.pacer.Do(func() error {
+		var err error
+		target, err = context.targetSvc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(context.target),
+			Key:    aws.String(key),
+		})
+		return err
 	})
+	context.metrics.HeadLatency.WithLabelValues("head-target").Observe(time.Since(headTargetStart).Seconds())
 	if targetErr != nil {
 		if aerr, ok := targetErr.(awserr.Error); ok {
 			switch aerr.Code() {
 			case "NotFound":
 				target = nil
 			default:
+				context.metrics.recordS3Error("head-target", targetErr)
 				os.Stderr.WriteString(fmt.Sprintf("\n***Missing target Head for `%s` failed (code %s): \n%T\n%v\n",
 					key, aerr.Code(), targetErr, targetErr))
 			}
 		} else {
+			context.metrics.recordS3Error("head-target", targetErr)
 			return fmt.Errorf("\naws sdk Head for target `%s` failed, can not recognize the aws return code: \n%T\n%v\n",
 				key, fromErr, fromErr)
 		}
@@ -398,10 +833,11 @@ func cp(context *CopyContext, name string) error {
 	// g - was image/png; adjusted CacheControl
 	// P - pdf file; adjusted CacheControl
 	// Y - other file type; adjusted CacheControl
+	// M - multipart-copied, source at or above --multipart-threshold-mb
 	if context.exclude.MatchString(name) && IsPicture(from) {
 		status = "E"
 	} else if target != nil && target.CacheControl != nil && *target.CacheControl == context.newvalue &&
-		target.ContentType != nil {
+		target.ContentType != nil && targetUpToDate(target, storageClass, sseInput) {
 		status = "."
 	} else if context.copiedObjects > context.maxObjectsToCopy {
 		status = ","
@@ -425,31 +861,79 @@ func cp(context *CopyContext, name string) error {
 		}
 
 		src := fmt.Sprintf("%s/%s", context.from, url.PathEscape(name))
-		inp := s3.CopyObjectInput{
-			Bucket:            aws.String(context.target),
-			CopySource:        &src,
-			Key:               &name,
-			CacheControl:      &context.newvalue,
-			ContentType:       contenttype,
-			MetadataDirective: aws.String("REPLACE"),
-		}
-		if !context.noop {
-			_, err := context.s3svc.CopyObject(&inp)
-			if err != nil {
-				return fmt.Errorf("Failed changing (inplace-copying) object: %v", err)
+		copyStart := time.Now()
+		if context.crossProvider {
+			// CopyObject/UploadPartCopy only work within a single
+			// provider, since CopySource is resolved by the target
+			// endpoint itself. Across providers we have to stream the
+			// object through this process instead.
+			if from.ContentLength != nil && *from.ContentLength >= context.multipartThreshold {
+				status = "M"
+				if !context.noop {
+					if err := streamMultipartCopy(context, name, *from.ContentLength, contenttype, from.Metadata, storageClass, sseInput); err != nil {
+						context.metrics.recordS3Error("copy", err)
+						return fmt.Errorf("Failed streaming-multipart-copying object: %v", err)
+					}
+				}
+			} else if !context.noop {
+				if err := streamCopy(context, name, contenttype, storageClass, sseInput); err != nil {
+					context.metrics.recordS3Error("copy", err)
+					return fmt.Errorf("Failed streaming-copying object: %v", err)
+				}
+			}
+		} else if from.ContentLength != nil && *from.ContentLength >= context.multipartThreshold {
+			status = "M"
+			if !context.noop {
+				if err := multipartCopy(context, name, src, *from.ContentLength, contenttype, from.Metadata, storageClass, sseInput); err != nil {
+					context.metrics.recordS3Error("copy", err)
+					return fmt.Errorf("Failed multipart-copying object: %v", err)
+				}
+			}
+		} else {
+			inp := s3.CopyObjectInput{
+				Bucket:            aws.String(context.target),
+				CopySource:        &src,
+				Key:               &name,
+				CacheControl:      &context.newvalue,
+				ContentType:       contenttype,
+				MetadataDirective: aws.String("REPLACE"),
+				StorageClass:      storageClass,
+			}
+			applySSE(&inp, sseInput)
+			if !context.noop {
+				err := context.pacer.Do(func() error {
+					_, err := context.targetSvc.CopyObject(&inp)
+					return err
+				})
+				if err != nil {
+					context.metrics.recordS3Error("copy", err)
+					return fmt.Errorf("Failed changing (inplace-copying) object: %v", err)
+				}
 			}
 		}
+		context.metrics.HeadLatency.WithLabelValues("copy").Observe(time.Since(copyStart).Seconds())
 		atomic.AddInt64(&context.copiedObjects, 1)
+		context.metrics.ObjectsCopied.Inc()
+		if from.ContentLength != nil {
+			atomic.AddInt64(&context.copiedBytes, *from.ContentLength)
+			context.metrics.BytesCopied.Add(float64(*from.ContentLength))
+		}
+		// Only count transitioned/kept for objects actually copied -
+		// counting it on the skip path above would report storage-class
+		// transitions for objects this run never touched.
+		if transitioned {
+			context.metrics.StorageClassStats.WithLabelValues("transitioned").Inc()
+		} else {
+			context.metrics.StorageClassStats.WithLabelValues("kept").Inc()
+		}
 	}
 	fmt.Print(status)
-	context.statsMutex.Lock()
-	context.statusStats[status] += 1
+	context.metrics.ObjectsProcessed.WithLabelValues(status).Inc()
 	// extract interesting part before semicolon, like "mulitpart/package"
 	// from `multipart/package; boundary="_-------------1437962543790"`
 	ctype := strings.Split(*contenttype, ";")[0]
-	context.typeStats[ctype] += 1
-
-	context.statsMutex.Unlock()
+	context.metrics.TypeStats.WithLabelValues(ctype).Inc()
+	context.metrics.CopyDuration.Observe(time.Since(opStart).Seconds())
 
 	atomic.AddInt64(&context.processedObjects, 1)
 	sec := time.Since(context.start).Seconds()
@@ -482,14 +966,322 @@ func cp(context *CopyContext, name string) error {
 			name, context.processedObjects, context.expectedObjects, o_s, eta,
 		)
 		fmt.Printf("\nContent-Type stats:\n")
-		for k, v := range context.typeStats {
+		for k, v := range counterVecSnapshot(context.metrics.TypeStats, "content_type") {
 			fmt.Printf("%s %d\n", k, v)
 		}
 		fmt.Printf("\nCopy status stats:\n")
-		for k, v := range context.statusStats {
+		for k, v := range counterVecSnapshot(context.metrics.ObjectsProcessed, "status") {
+			fmt.Printf("%s %d\n", k, v)
+		}
+		fmt.Printf("\nStorage-class stats:\n")
+		for k, v := range counterVecSnapshot(context.metrics.StorageClassStats, "outcome") {
 			fmt.Printf("%s %d\n", k, v)
 		}
+		fmt.Printf("\nPacer: delay %v, %d retries\n", context.pacer.Delay(), context.pacer.Retries())
 		context.statsMutex.Unlock()
 	}
 	return nil
 }
+
+// multipartCopy copies a single object via CreateMultipartUpload +
+// UploadPartCopy, which is the only way S3 allows copying sources larger
+// than 5 GiB (CopyObject rejects those with "InvalidRequest: specified
+// copy source is larger than the maximum allowable size for a copy
+// source"). CacheControl/ContentType/metadata have to be set on
+// CreateMultipartUpload, since there is no MetadataDirective for
+// multipart uploads. The upload is aborted if any part fails.
+func multipartCopy(context *CopyContext, name string, copySource string, size int64, contenttype *string, metadata map[string]*string, storageClass *string, sse sseParams) error {
+	createInp := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(context.target),
+		Key:          aws.String(name),
+		CacheControl: &context.newvalue,
+		ContentType:  contenttype,
+		Metadata:     metadata,
+		StorageClass: storageClass,
+	}
+	sse.applyToCreateMultipartUpload(createInp)
+	var created *s3.CreateMultipartUploadOutput
+	err := context.pacer.Do(func() error {
+		var err error
+		created, err = context.targetSvc.CreateMultipartUpload(createInp)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("CreateMultipartUpload for `%s` failed: %v", name, err)
+	}
+	uploadID := created.UploadId
+
+	partSize := context.multipartPartSize
+	if partSize <= 0 {
+		partSize = defaultMultipartPartSize
+	}
+	numParts := int((size + partSize - 1) / partSize)
+
+	concurrency := context.multipartConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		mu        sync.Mutex
+		completed = make([]*s3.CompletedPart, 0, numParts)
+		firstErr  error
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, concurrency)
+	)
+
+	for i := 0; i < numParts; i++ {
+		start := int64(i) * partSize
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		partNumber := int64(i + 1)
+		byteRange := fmt.Sprintf("bytes=%d-%d", start, end)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(partNumber int64, byteRange string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			partInp := &s3.UploadPartCopyInput{
+				Bucket:          aws.String(context.target),
+				Key:             aws.String(name),
+				UploadId:        uploadID,
+				PartNumber:      aws.Int64(partNumber),
+				CopySource:      aws.String(copySource),
+				CopySourceRange: aws.String(byteRange),
+			}
+			sse.applyToUploadPartCopy(partInp)
+			var result *s3.UploadPartCopyOutput
+			err := context.pacer.Do(func() error {
+				var err error
+				result, err = context.targetSvc.UploadPartCopy(partInp)
+				return err
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("UploadPartCopy part %d of `%s` failed: %v", partNumber, name, err)
+				}
+				return
+			}
+			completed = append(completed, &s3.CompletedPart{
+				ETag:       result.CopyPartResult.ETag,
+				PartNumber: aws.Int64(partNumber),
+			})
+		}(partNumber, byteRange)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		abortErr := context.pacer.Do(func() error {
+			_, err := context.targetSvc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(context.target),
+				Key:      aws.String(name),
+				UploadId: uploadID,
+			})
+			return err
+		})
+		if abortErr != nil {
+			os.Stderr.WriteString(fmt.Sprintf("Failed to abort multipart upload for `%s`: %v\n", name, abortErr))
+		}
+		return firstErr
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+
+	err = context.pacer.Do(func() error {
+		_, err := context.targetSvc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(context.target),
+			Key:             aws.String(name),
+			UploadId:        uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("CompleteMultipartUpload for `%s` failed: %v", name, err)
+	}
+	return nil
+}
+
+// streamCopy copies a single object between two different S3-compatible
+// providers (e.g. MinIO to AWS) by streaming a GetObject response
+// straight into a PutObject request, since server-side CopyObject only
+// works within one provider. The same CacheControl/ContentType
+// normalization used for same-provider copies is preserved.
+//
+// GetObject and PutObject are retried together as a single pacer.Do unit,
+// re-fetching the source on every attempt, since a PutObject retry can't
+// safely reuse a GetObject body it already started streaming from.
+func streamCopy(context *CopyContext, name string, contenttype *string, storageClass *string, sse sseParams) error {
+	err := context.pacer.Do(func() error {
+		obj, err := context.fromSvc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(context.from),
+			Key:    aws.String(name),
+		})
+		if err != nil {
+			return err
+		}
+		defer obj.Body.Close()
+
+		putInp := &s3.PutObjectInput{
+			Bucket:       aws.String(context.target),
+			Key:          aws.String(name),
+			Body:         aws.ReadSeekCloser(obj.Body),
+			CacheControl: &context.newvalue,
+			ContentType:  contenttype,
+			Metadata:     obj.Metadata,
+			StorageClass: storageClass,
+		}
+		sse.applyToPutObject(putInp)
+		_, err = context.targetSvc.PutObject(putInp)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("streaming copy for `%s` failed: %v", name, err)
+	}
+	return nil
+}
+
+// streamMultipartCopy is streamCopy's counterpart for sources at or above
+// the multipart threshold: PutObject is capped at 5 GiB same as
+// CopyObject, so a large object can't be streamed in one request either.
+// Since UploadPartCopy's CopySource can't resolve across providers, each
+// part is instead read from the source via a ranged GetObject and sent on
+// with UploadPart, mirroring multipartCopy's CreateMultipartUpload/
+// UploadPartCopy/CompleteMultipartUpload shape and concurrency.
+func streamMultipartCopy(context *CopyContext, name string, size int64, contenttype *string, metadata map[string]*string, storageClass *string, sse sseParams) error {
+	createInp := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(context.target),
+		Key:          aws.String(name),
+		CacheControl: &context.newvalue,
+		ContentType:  contenttype,
+		Metadata:     metadata,
+		StorageClass: storageClass,
+	}
+	sse.applyToCreateMultipartUpload(createInp)
+	var created *s3.CreateMultipartUploadOutput
+	err := context.pacer.Do(func() error {
+		var err error
+		created, err = context.targetSvc.CreateMultipartUpload(createInp)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("CreateMultipartUpload for `%s` failed: %v", name, err)
+	}
+	uploadID := created.UploadId
+
+	partSize := context.multipartPartSize
+	if partSize <= 0 {
+		partSize = defaultMultipartPartSize
+	}
+	numParts := int((size + partSize - 1) / partSize)
+
+	concurrency := context.multipartConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		mu        sync.Mutex
+		completed = make([]*s3.CompletedPart, 0, numParts)
+		firstErr  error
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, concurrency)
+	)
+
+	for i := 0; i < numParts; i++ {
+		start := int64(i) * partSize
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		partNumber := int64(i + 1)
+		byteRange := fmt.Sprintf("bytes=%d-%d", start, end)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(partNumber int64, byteRange string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var result *s3.UploadPartOutput
+			err := context.pacer.Do(func() error {
+				obj, err := context.fromSvc.GetObject(&s3.GetObjectInput{
+					Bucket: aws.String(context.from),
+					Key:    aws.String(name),
+					Range:  aws.String(byteRange),
+				})
+				if err != nil {
+					return err
+				}
+				defer obj.Body.Close()
+
+				partInp := &s3.UploadPartInput{
+					Bucket:     aws.String(context.target),
+					Key:        aws.String(name),
+					UploadId:   uploadID,
+					PartNumber: aws.Int64(partNumber),
+					Body:       aws.ReadSeekCloser(obj.Body),
+				}
+				sse.applyToUploadPart(partInp)
+				result, err = context.targetSvc.UploadPart(partInp)
+				return err
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("UploadPart part %d of `%s` failed: %v", partNumber, name, err)
+				}
+				return
+			}
+			completed = append(completed, &s3.CompletedPart{
+				ETag:       result.ETag,
+				PartNumber: aws.Int64(partNumber),
+			})
+		}(partNumber, byteRange)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		abortErr := context.pacer.Do(func() error {
+			_, err := context.targetSvc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(context.target),
+				Key:      aws.String(name),
+				UploadId: uploadID,
+			})
+			return err
+		})
+		if abortErr != nil {
+			os.Stderr.WriteString(fmt.Sprintf("Failed to abort multipart upload for `%s`: %v\n", name, abortErr))
+		}
+		return firstErr
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+
+	err = context.pacer.Do(func() error {
+		_, err := context.targetSvc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(context.target),
+			Key:             aws.String(name),
+			UploadId:        uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("CompleteMultipartUpload for `%s` failed: %v", name, err)
+	}
+	return nil
+}